@@ -21,32 +21,56 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/jsonconfig"
 	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/serverconfig/dsn"
 )
 
 const (
 	DefaultTLSCert = "config/selfgen_pem.crt"
 	DefaultTLSKey  = "config/selfgen_pem.key"
+
+	// defaultCacheMaxBytes is the "/cache/" size cap used when the
+	// high-level "cache" option (or its "maxBytes" field) is unset, so
+	// that out-of-the-box deployments don't fill up the disk.
+	defaultCacheMaxBytes = 1 << 30 // 1GB
 )
 
 // various parameters derived from the high-level user config
 // and needed to set up the low-level config.
 type configPrefixesParams struct {
-	secretRing   string
-	keyId        string
-	indexerPath  string
-	blobPath     string
-	searchOwner  *blobref.BlobRef
-	shareHandler bool
+	base            string // prefix tree mount point; "" for the root owner, "/t/<name>" for a tenant
+	auth            string // handler auth, e.g. for a tenant's own root handler; "" to omit
+	secretRing      string
+	keyId           string
+	indexerPath     string
+	blobPath        string
+	searchOwner     *blobref.BlobRef
+	shareHandler    bool
+	encryptKeyFile  string                 // non-empty enables storage-encrypt on top of the primary blob storage
+	encryptMetaArgs map[string]interface{} // handlerArgs for the encrypt meta-index, or nil to use its default
+	cachePath       string                 // on-disk location of the "/cache/" handler
+	cacheMaxBytes   int64                  // cap for the "/cache/" storage-diskcache handler
+}
+
+// cacheHandlerArgs returns the handlerArgs for a bounded storage-diskcache
+// handler rooted at path, which LRU-evicts blobs once it holds more than
+// maxBytes.
+func cacheHandlerArgs(path string, maxBytes int64) map[string]interface{} {
+	return map[string]interface{}{
+		"path":     path,
+		"maxBytes": maxBytes,
+	}
 }
 
 var tempDir = os.TempDir
 
-func addPublishedConfig(prefixes jsonconfig.Obj, published jsonconfig.Obj) ([]interface{}, error) {
+func addPublishedConfig(prefixes jsonconfig.Obj, base string, published jsonconfig.Obj) ([]interface{}, error) {
 	pubPrefixes := []interface{}{}
 	for k, v := range published {
 		p, ok := v.(map[string]interface{})
@@ -78,10 +102,10 @@ func addPublishedConfig(prefixes jsonconfig.Obj, published jsonconfig.Obj) ([]in
 		ob["handler"] = "publish"
 		handlerArgs := map[string]interface{}{
 			"rootName":      rootName,
-			"blobRoot":      "/bs-and-maybe-also-index/",
-			"searchRoot":    "/my-search/",
-			"cache":         "/cache/",
-			"rootPermanode": []interface{}{"/sighelper/", rootPermanode},
+			"blobRoot":      base + "/bs-and-maybe-also-index/",
+			"searchRoot":    base + "/my-search/",
+			"cache":         base + "/cache/",
+			"rootPermanode": []interface{}{base + "/sighelper/", rootPermanode},
 		}
 		switch template {
 		case "gallery":
@@ -97,182 +121,477 @@ func addPublishedConfig(prefixes jsonconfig.Obj, published jsonconfig.Obj) ([]in
 			}
 		}
 		ob["handlerArgs"] = handlerArgs
-		prefixes[k] = ob
-		pubPrefixes = append(pubPrefixes, k)
+		prefixes[base+k] = ob
+		pubPrefixes = append(pubPrefixes, base+k)
 	}
 	return pubPrefixes, nil
 }
 
-func addUIConfig(prefixes jsonconfig.Obj, uiPrefix string, published []interface{}) {
+func addUIConfig(prefixes jsonconfig.Obj, base string, published []interface{}) {
 	ob := map[string]interface{}{}
 	ob["handler"] = "ui"
 	handlerArgs := map[string]interface{}{
-		"jsonSignRoot": "/sighelper/",
-		"cache":        "/cache/",
+		"jsonSignRoot": base + "/sighelper/",
+		"cache":        base + "/cache/",
 		"scaledImage":  "lrucache",
 	}
 	if len(published) > 0 {
 		handlerArgs["publishRoots"] = published
 	}
 	ob["handlerArgs"] = handlerArgs
-	prefixes[uiPrefix] = ob
+	prefixes[base+"/ui/"] = ob
 }
 
-func addMongoConfig(prefixes jsonconfig.Obj, dbname string, dbinfo string) {
-	fields := strings.Split(dbinfo, "@")
-	if len(fields) != 2 {
-		exitFailure("Malformed mongo config string. Got \"%v\", want: \"user:password@host\"", dbinfo)
+func addMongoConfig(prefixes jsonconfig.Obj, base string, dbname string, dbinfo string) {
+	info, err := dsn.ParseMongo(dbinfo)
+	if err != nil {
+		exitFailure("%v", err)
 	}
-	host := fields[1]
-	fields = strings.Split(fields[0], ":")
-	if len(fields) != 2 {
-		exitFailure("Malformed mongo config string. Got \"%v\", want: \"user:password\"", fields[0])
+	if info.Database != "" {
+		dbname = info.Database
+	}
+	host := info.Host
+	if info.Port != "" {
+		host += ":" + info.Port
 	}
 	ob := map[string]interface{}{}
 	ob["enabled"] = true
 	ob["handler"] = "storage-mongodbindexer"
 	ob["handlerArgs"] = map[string]interface{}{
 		"host":       host,
-		"user":       fields[0],
-		"password":   fields[1],
+		"user":       info.User,
+		"password":   info.Password,
 		"database":   dbname,
-		"blobSource": "/bs/",
+		"blobSource": base + "/bs/",
 	}
-	prefixes["/index-mongo/"] = ob
+	prefixes[base+"/index-mongo/"] = ob
 }
 
-func addSQLConfig(rdbms string, prefixes jsonconfig.Obj, dbname string, dbinfo string) {
-	fields := strings.Split(dbinfo, "@")
-	if len(fields) != 2 {
-		exitFailure("Malformed " + rdbms + " config string. Want: \"user@host:password\"")
+func addSQLConfig(rdbms string, prefixes jsonconfig.Obj, base string, dbname string, dbinfo string) {
+	info, err := dsn.ParseSQL(rdbms, dbinfo)
+	if err != nil {
+		exitFailure("%v", err)
+	}
+	if info.Database != "" {
+		dbname = info.Database
+	}
+	host := info.Host
+	if info.Port != "" {
+		host += ":" + info.Port
+	}
+	handlerArgs := map[string]interface{}{
+		"host":       host,
+		"user":       info.User,
+		"password":   info.Password,
+		"database":   dbname,
+		"blobSource": base + "/bs/",
 	}
-	user := fields[0]
-	fields = strings.Split(fields[1], ":")
-	if len(fields) != 2 {
-		exitFailure("Malformed " + rdbms + " config string. Want: \"user@host:password\"")
+	if info.SSLMode != "" {
+		handlerArgs["sslmode"] = info.SSLMode
 	}
 	ob := map[string]interface{}{}
 	ob["enabled"] = true
 	ob["handler"] = "storage-" + rdbms + "indexer"
-	ob["handlerArgs"] = map[string]interface{}{
-		"host":       fields[0],
-		"user":       user,
-		"password":   fields[1],
-		"database":   dbname,
-		"blobSource": "/bs/",
-	}
-	prefixes["/index-"+rdbms+"/"] = ob
+	ob["handlerArgs"] = handlerArgs
+	prefixes[base+"/index-"+rdbms+"/"] = ob
 }
 
-func addPostgresConfig(prefixes jsonconfig.Obj, dbname string, dbinfo string) {
-	addSQLConfig("postgres", prefixes, dbname, dbinfo)
+func addPostgresConfig(prefixes jsonconfig.Obj, base string, dbname string, dbinfo string) {
+	addSQLConfig("postgres", prefixes, base, dbname, dbinfo)
 }
 
-func addMySQLConfig(prefixes jsonconfig.Obj, dbname string, dbinfo string) {
-	addSQLConfig("mysql", prefixes, dbname, dbinfo)
+func addMySQLConfig(prefixes jsonconfig.Obj, base string, dbname string, dbinfo string) {
+	addSQLConfig("mysql", prefixes, base, dbname, dbinfo)
 }
 
-func addMemindexConfig(prefixes jsonconfig.Obj) {
+func addMemindexConfig(prefixes jsonconfig.Obj, base string) {
 	ob := map[string]interface{}{}
 	ob["handler"] = "storage-memory-only-dev-indexer"
 	ob["handlerArgs"] = map[string]interface{}{
-		"blobSource": "/bs/",
+		"blobSource": base + "/bs/",
 	}
-	prefixes["/index-mem/"] = ob
+	prefixes[base+"/index-mem/"] = ob
 }
 
-func addSQLiteConfig(prefixes jsonconfig.Obj, file string) {
+func addSQLiteConfig(prefixes jsonconfig.Obj, base string, file string) {
 	ob := map[string]interface{}{}
 	ob["handler"] = "storage-sqliteindexer"
 	ob["handlerArgs"] = map[string]interface{}{
-		"blobSource": "/bs/",
+		"blobSource": base + "/bs/",
 		"file":       file,
 	}
-	prefixes["/index-sqlite/"] = ob
+	prefixes[base+"/index-sqlite/"] = ob
+}
+
+// encryptMetaIndexArgs builds the handlerArgs for storage-encrypt's small
+// plaintext-blobref-to-ciphertext-blobref meta-index, reusing the same
+// sqlite/mysql/postgres/mongo connection strings as the search indexers.
+func encryptMetaIndexArgs(metaIndex jsonconfig.Obj, dbname string) (map[string]interface{}, error) {
+	sqliteFile, _ := metaIndex["sqlite"].(string)
+	mysql, _ := metaIndex["mysql"].(string)
+	postgres, _ := metaIndex["postgres"].(string)
+	mongo, _ := metaIndex["mongo"].(string)
+	if v, ok := metaIndex["dbname"].(string); ok && v != "" {
+		dbname = v
+	}
+
+	switch {
+	case sqliteFile != "":
+		return map[string]interface{}{
+			"type": "sqlite",
+			"file": sqliteFile,
+		}, nil
+	case mysql != "" || postgres != "":
+		rdbms, dbinfo := "mysql", mysql
+		if postgres != "" {
+			rdbms, dbinfo = "postgres", postgres
+		}
+		info, err := dsn.ParseSQL(rdbms, dbinfo)
+		if err != nil {
+			return nil, err
+		}
+		host := info.Host
+		if info.Port != "" {
+			host += ":" + info.Port
+		}
+		handlerArgs := map[string]interface{}{
+			"type":     rdbms,
+			"host":     host,
+			"user":     info.User,
+			"password": info.Password,
+			"database": dbname,
+		}
+		if info.SSLMode != "" {
+			handlerArgs["sslmode"] = info.SSLMode
+		}
+		return handlerArgs, nil
+	case mongo != "":
+		info, err := dsn.ParseMongo(mongo)
+		if err != nil {
+			return nil, err
+		}
+		host := info.Host
+		if info.Port != "" {
+			host += ":" + info.Port
+		}
+		return map[string]interface{}{
+			"type":     "mongo",
+			"host":     host,
+			"user":     info.User,
+			"password": info.Password,
+			"database": dbname,
+		}, nil
+	default:
+		return nil, errors.New(`genconfig: "encrypt.metaIndex" needs one of "sqlite", "mysql", "postgres", or "mongo"`)
+	}
+}
+
+// cloudBackend describes how to turn a colon-separated high-level config
+// string (e.g. the "s3" or "swift" option) into a storage-* handler.
+type cloudBackend struct {
+	name    string // e.g. "s3"; used to name the "/sto-<name>/" prefix
+	handler string // low-level handler, e.g. "storage-s3"
+	parse   func(spec string) (map[string]interface{}, error)
+}
+
+func parseS3Args(s3 string) (map[string]interface{}, error) {
+	info, err := dsn.ParseS3(s3)
+	if err != nil {
+		return nil, err
+	}
+	bucket := info.Bucket
+	if info.Prefix != "" {
+		bucket += "/" + info.Prefix
+	}
+	handlerArgs := map[string]interface{}{
+		"aws_access_key":        info.AccessKey,
+		"aws_secret_access_key": info.SecretKey,
+		"bucket":                bucket,
+	}
+	if info.Region != "" {
+		handlerArgs["region"] = info.Region
+	}
+	if info.Endpoint != "" {
+		handlerArgs["hostname"] = info.Endpoint
+	}
+	return handlerArgs, nil
+}
+
+func parseGCSArgs(gcs string) (map[string]interface{}, error) {
+	f := strings.SplitN(gcs, ":", 4)
+	if len(f) != 4 {
+		return nil, errors.New(`genconfig: expected "googlecloudstorage" field to be of form "client_id:client_secret:refresh_token:bucket"`)
+	}
+	return map[string]interface{}{
+		"client_id":     f[0],
+		"client_secret": f[1],
+		"refresh_token": f[2],
+		"bucket":        f[3],
+	}, nil
+}
+
+func parseSwiftArgs(swift string) (map[string]interface{}, error) {
+	f := strings.SplitN(swift, ":", 5)
+	if len(f) != 5 {
+		return nil, errors.New(`genconfig: expected "swift" field to be of form "user:key:tenant:authurl:container"`)
+	}
+	return map[string]interface{}{
+		"user":      f[0],
+		"key":       f[1],
+		"tenant":    f[2],
+		"auth_url":  f[3],
+		"container": f[4],
+	}, nil
+}
+
+// cloudBackends are the cloud storage kinds that can be set as the
+// top-level "s3", "googlecloudstorage", or "swift" option, or listed
+// as a "replication" backend.
+var cloudBackends = map[string]cloudBackend{
+	"s3":                 {"s3", "storage-s3", parseS3Args},
+	"googlecloudstorage": {"googlecloudstorage", "storage-googlecloudstorage", parseGCSArgs},
+	"swift":              {"swift", "storage-swift", parseSwiftArgs},
 }
 
-func addS3Config(prefixes jsonconfig.Obj, s3 string) error {
-	f := strings.SplitN(s3, ":", 3)
-	if len(f) != 3 {
-		return errors.New(`genconfig: expected "s3" field to be of form "access_key_id:secret_access_key:bucket"`)
+// addCloudConfig wires the cloud storage backend named by kind (a key of
+// cloudBackends) into prefixes: as the primary "<base>/bs/" if no local
+// disk is configured yet, or as a secondary "<base>/sto-<kind>/" kept in
+// sync from "<base>/bs/" otherwise. cachePath and cacheMaxBytes configure
+// the "/cache/" handler generated for the primary case.
+func addCloudConfig(prefixes jsonconfig.Obj, base, kind, spec, cachePath string, cacheMaxBytes int64) error {
+	cb, ok := cloudBackends[kind]
+	if !ok {
+		return fmt.Errorf("genconfig: unknown cloud storage kind %q", kind)
+	}
+	handlerArgs, err := cb.parse(spec)
+	if err != nil {
+		return err
 	}
-	accessKey, secret, bucket := f[0], f[1], f[2]
 
 	isPrimary := false
-	if _, ok := prefixes["/bs/"]; !ok {
+	if _, ok := prefixes[base+"/bs/"]; !ok {
 		isPrimary = true
 	}
-	s3Prefix := ""
+	prefix := base + "/sto-" + cb.name + "/"
 	if isPrimary {
-		s3Prefix = "/bs/"
-	} else {
-		s3Prefix = "/sto-s3/"
+		prefix = base + "/bs/"
 	}
-	prefixes[s3Prefix] = map[string]interface{}{
-		"handler": "storage-s3",
-		"handlerArgs": map[string]interface{}{
-			"aws_access_key":        accessKey,
-			"aws_secret_access_key": secret,
-			"bucket":                bucket,
-		},
+	prefixes[prefix] = map[string]interface{}{
+		"handler":     cb.handler,
+		"handlerArgs": handlerArgs,
 	}
 	if isPrimary {
-		// TODO(mpl): s3CacheBucket
-		// See http://code.google.com/p/camlistore/issues/detail?id=85
-		prefixes["/cache/"] = map[string]interface{}{
-			"handler": "storage-filesystem",
+		prefixes[base+"/cache/"] = map[string]interface{}{
+			"handler":     "storage-diskcache",
+			"handlerArgs": cacheHandlerArgs(cachePath, cacheMaxBytes),
+		}
+	} else {
+		prefixes[base+"/sync-to-"+cb.name+"/"] = map[string]interface{}{
+			"handler": "sync",
 			"handlerArgs": map[string]interface{}{
-				"path": filepath.Join(tempDir(), "camli-cache"),
+				"from": base + "/bs/",
+				"to":   prefix,
 			},
 		}
-	} else {
-		prefixes["/sync-to-s3/"] = map[string]interface{}{
+	}
+	return nil
+}
+
+func addS3Config(prefixes jsonconfig.Obj, base, s3, cachePath string, cacheMaxBytes int64) error {
+	return addCloudConfig(prefixes, base, "s3", s3, cachePath, cacheMaxBytes)
+}
+
+func addGCSConfig(prefixes jsonconfig.Obj, base, gcs, cachePath string, cacheMaxBytes int64) error {
+	return addCloudConfig(prefixes, base, "googlecloudstorage", gcs, cachePath, cacheMaxBytes)
+}
+
+func addSwiftConfig(prefixes jsonconfig.Obj, base, swift, cachePath string, cacheMaxBytes int64) error {
+	return addCloudConfig(prefixes, base, "swift", swift, cachePath, cacheMaxBytes)
+}
+
+// addReplicaBackend adds one storage backend listed in a "replication"
+// config's "backends" entry at the given prefix. Unlike addCloudConfig,
+// it never becomes "/bs/": replication backends are always secondaries
+// of the existing primary.
+func addReplicaBackend(prefixes jsonconfig.Obj, prefix string, spec map[string]interface{}) error {
+	if len(spec) != 1 {
+		return errors.New(`genconfig: replication backend must have exactly one of "blobPath", "s3", "googlecloudstorage", or "swift"`)
+	}
+	for kind, v := range spec {
+		val, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("genconfig: expected a string value for %q", kind)
+		}
+		if kind == "blobPath" {
+			prefixes[prefix] = map[string]interface{}{
+				"handler": "storage-filesystem",
+				"handlerArgs": map[string]interface{}{
+					"path": val,
+				},
+			}
+			return nil
+		}
+		cb, ok := cloudBackends[kind]
+		if !ok {
+			return fmt.Errorf("genconfig: unsupported replication backend type %q", kind)
+		}
+		handlerArgs, err := cb.parse(val)
+		if err != nil {
+			return err
+		}
+		prefixes[prefix] = map[string]interface{}{
+			"handler":     cb.handler,
+			"handlerArgs": handlerArgs,
+		}
+	}
+	return nil
+}
+
+// addReplicationConfig turns a high-level "replication" object into a
+// storage-replica handler fronting the physical primary "/bs/" plus the
+// configured secondary backends, with a sync handler per secondary for
+// asynchronous catch-up after a write that didn't reach every replica.
+//
+// storage-replica forwards the identical blob bytes to every one of its
+// backends, so if encryption is enabled (encryptKeyFile != ""), the
+// replica set is built at the internal "/bs-replicated-raw/" prefix
+// instead, and the existing "/encrypt-bs/" handler (built by
+// genLowLevelPrefixes to wrap the single "/bs/") is rewired to wrap the
+// whole replica set instead of just "/bs/". That way every backend,
+// not only the former primary, receives the same already-encrypted
+// bytes; every consumer already points at blobRoot ("/encrypt-bs/"),
+// so nothing else needs rewiring.
+//
+// Without encryption, the replica set is exposed directly at
+// "/bs-replicated/", and every consumer of "/bs/" is rewired to it
+// instead: the root handler directly if there's no indexer, or
+// otherwise the "/bs-and-maybe-also-index/" cond handler backing it
+// (so the isSchema dual-write to the indexer still happens), plus the
+// share handler and the "/bs-and-index/" backends if present.
+func addReplicationConfig(prefixes jsonconfig.Obj, blobRoot, encryptKeyFile string, replication jsonconfig.Obj) error {
+	backendSpecs, ok := replication["backends"].([]interface{})
+	if !ok || len(backendSpecs) == 0 {
+		return errors.New(`genconfig: "replication" requires a non-empty "backends" list`)
+	}
+
+	replicatedPrefix := "/bs-replicated/"
+	if encryptKeyFile != "" {
+		replicatedPrefix = "/bs-replicated-raw/"
+	}
+
+	backends := []interface{}{"/bs/"}
+	for i, bv := range backendSpecs {
+		spec, ok := bv.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("genconfig: replication backend %d must be an object", i)
+		}
+		prefix := fmt.Sprintf("/sto-replica%d/", i)
+		if err := addReplicaBackend(prefixes, prefix, spec); err != nil {
+			return fmt.Errorf("genconfig: replication backend %d: %v", i, err)
+		}
+		backends = append(backends, prefix)
+		prefixes[fmt.Sprintf("/sync-to-replica%d/", i)] = map[string]interface{}{
 			"handler": "sync",
 			"handlerArgs": map[string]interface{}{
-				"from": "/bs/",
-				"to":   s3Prefix,
+				"from": replicatedPrefix,
+				"to":   prefix,
 			},
 		}
 	}
+
+	minWrites := len(backends)
+	if v, ok := replication["minWritesForSuccess"]; ok {
+		f, ok := v.(float64)
+		if !ok {
+			return errors.New(`genconfig: "minWritesForSuccess" must be a number`)
+		}
+		minWrites = int(f)
+	}
+	if minWrites < 1 || minWrites > len(backends) {
+		return fmt.Errorf(`genconfig: "minWritesForSuccess" must be between 1 and the number of backends (%d), got %d`, len(backends), minWrites)
+	}
+
+	prefixes[replicatedPrefix] = map[string]interface{}{
+		"handler": "storage-replica",
+		"handlerArgs": map[string]interface{}{
+			"backends":            backends,
+			"minWritesForSuccess": minWrites,
+		},
+	}
+
+	if encryptKeyFile != "" {
+		setMap(prefixes, blobRoot, "handlerArgs", "blobRoot", replicatedPrefix)
+		return nil
+	}
+
+	if condHandler, ok := prefixes["/bs-and-maybe-also-index/"].(map[string]interface{}); ok {
+		handlerArgs := condHandler["handlerArgs"].(map[string]interface{})
+		setMap(handlerArgs, "write", "else", replicatedPrefix)
+		handlerArgs["read"] = replicatedPrefix
+	} else {
+		setMap(prefixes, "/", "handlerArgs", "blobRoot", replicatedPrefix)
+	}
+	if _, ok := prefixes["/share/"]; ok {
+		setMap(prefixes, "/share/", "handlerArgs", "blobRoot", replicatedPrefix)
+	}
+	if bsAndIndex, ok := prefixes["/bs-and-index/"].(map[string]interface{}); ok {
+		indexerPath := bsAndIndex["handlerArgs"].(map[string]interface{})["backends"].([]interface{})[1]
+		setMap(prefixes, "/sync/", "handlerArgs", "from", replicatedPrefix)
+		setMap(prefixes, "/bs-and-index/", "handlerArgs", "backends", []interface{}{replicatedPrefix, indexerPath})
+	}
 	return nil
 }
 
-func genLowLevelPrefixes(params *configPrefixesParams) (m jsonconfig.Obj) {
+// p namespaces a prefix under params.base, e.g. "/bs/" becomes
+// "/t/alice/bs/" for a tenant mounted at base "/t/alice".
+func (params *configPrefixesParams) p(suffix string) string {
+	return params.base + suffix
+}
+
+func genLowLevelPrefixes(params *configPrefixesParams) (m jsonconfig.Obj, blobRoot string) {
 	m = make(jsonconfig.Obj)
 
 	haveIndex := params.indexerPath != ""
-	root := "/bs/"
+	blobRoot = params.p("/bs/")
+	if params.encryptKeyFile != "" {
+		blobRoot = params.p("/encrypt-bs/")
+	}
+	root := blobRoot
 	pubKeyDest := root
 	if haveIndex {
-		root = "/bs-and-maybe-also-index/"
-		pubKeyDest = "/bs-and-index/"
+		root = params.p("/bs-and-maybe-also-index/")
+		pubKeyDest = params.p("/bs-and-index/")
 	}
 
-	m["/"] = map[string]interface{}{
-		"handler": "root",
-		"handlerArgs": map[string]interface{}{
-			"stealth":  false,
-			"blobRoot": root,
-		},
+	rootArgs := map[string]interface{}{
+		"stealth":  false,
+		"blobRoot": root,
+	}
+	if params.auth != "" {
+		rootArgs["auth"] = params.auth
+	}
+	m[params.p("/")] = map[string]interface{}{
+		"handler":     "root",
+		"handlerArgs": rootArgs,
 	}
 	if haveIndex {
-		setMap(m, "/", "handlerArgs", "searchRoot", "/my-search/")
+		setMap(m, params.p("/"), "handlerArgs", "searchRoot", params.p("/my-search/"))
 	}
 
-	m["/setup/"] = map[string]interface{}{
+	m[params.p("/setup/")] = map[string]interface{}{
 		"handler": "setup",
 	}
 
 	if params.shareHandler {
-		m["/share/"] = map[string]interface{}{
+		m[params.p("/share/")] = map[string]interface{}{
 			"handler": "share",
 			"handlerArgs": map[string]interface{}{
-				"blobRoot": "/bs/",
+				"blobRoot": blobRoot,
 			},
 		}
 	}
 
-	m["/sighelper/"] = map[string]interface{}{
+	m[params.p("/sighelper/")] = map[string]interface{}{
 		"handler": "jsonsign",
 		"handlerArgs": map[string]interface{}{
 			"secretRing":    params.secretRing,
@@ -282,50 +601,48 @@ func genLowLevelPrefixes(params *configPrefixesParams) (m jsonconfig.Obj) {
 	}
 
 	if params.blobPath != "" {
-		m["/bs/"] = map[string]interface{}{
+		m[params.p("/bs/")] = map[string]interface{}{
 			"handler": "storage-filesystem",
 			"handlerArgs": map[string]interface{}{
 				"path": params.blobPath,
 			},
 		}
 
-		m["/cache/"] = map[string]interface{}{
-			"handler": "storage-filesystem",
-			"handlerArgs": map[string]interface{}{
-				"path": filepath.Join(params.blobPath, "/cache"),
-			},
+		m[params.p("/cache/")] = map[string]interface{}{
+			"handler":     "storage-diskcache",
+			"handlerArgs": cacheHandlerArgs(params.cachePath, params.cacheMaxBytes),
 		}
 	}
 
 	if haveIndex {
-		m["/sync/"] = map[string]interface{}{
+		m[params.p("/sync/")] = map[string]interface{}{
 			"handler": "sync",
 			"handlerArgs": map[string]interface{}{
-				"from": "/bs/",
+				"from": blobRoot,
 				"to":   params.indexerPath,
 			},
 		}
 
-		m["/bs-and-index/"] = map[string]interface{}{
+		m[params.p("/bs-and-index/")] = map[string]interface{}{
 			"handler": "storage-replica",
 			"handlerArgs": map[string]interface{}{
-				"backends": []interface{}{"/bs/", params.indexerPath},
+				"backends": []interface{}{blobRoot, params.indexerPath},
 			},
 		}
 
-		m["/bs-and-maybe-also-index/"] = map[string]interface{}{
+		m[params.p("/bs-and-maybe-also-index/")] = map[string]interface{}{
 			"handler": "storage-cond",
 			"handlerArgs": map[string]interface{}{
 				"write": map[string]interface{}{
 					"if":   "isSchema",
-					"then": "/bs-and-index/",
-					"else": "/bs/",
+					"then": params.p("/bs-and-index/"),
+					"else": blobRoot,
 				},
-				"read": "/bs/",
+				"read": blobRoot,
 			},
 		}
 
-		m["/my-search/"] = map[string]interface{}{
+		m[params.p("/my-search/")] = map[string]interface{}{
 			"handler": "search",
 			"handlerArgs": map[string]interface{}{
 				"index": params.indexerPath,
@@ -334,9 +651,254 @@ func genLowLevelPrefixes(params *configPrefixesParams) (m jsonconfig.Obj) {
 		}
 	}
 
+	if params.encryptKeyFile != "" {
+		handlerArgs := map[string]interface{}{
+			"keyFile":  params.encryptKeyFile,
+			"blobRoot": params.p("/bs/"),
+		}
+		if params.encryptMetaArgs != nil {
+			handlerArgs["metaIndex"] = params.encryptMetaArgs
+		}
+		m[params.p("/encrypt-bs/")] = map[string]interface{}{
+			"handler":     "storage-encrypt",
+			"handlerArgs": handlerArgs,
+		}
+	}
+
 	return
 }
 
+// ownerSpec bundles the high-level settings needed to generate one
+// owner's prefix subtree: either the root owner (base == "") or one
+// entry of the top-level "tenants" object (base == "/t/<name>").
+type ownerSpec struct {
+	base         string // "" for the root owner, "/t/<name>" for a tenant
+	auth         string // non-empty to set the owner's root handler auth
+	keyId        string
+	secretRing   string
+	shareHandler bool
+
+	blobPath           string
+	s3                 string
+	googlecloudstorage string
+	swift              string
+
+	runIndex   bool
+	dbname     string
+	mysql      string
+	postgres   string
+	mongo      string
+	sqliteFile string
+	memIndex   bool
+
+	encryptKeyFile  string
+	encryptMetaArgs map[string]interface{}
+
+	cachePath     string // on-disk location of "/cache/"; "" to use the default
+	cacheMaxBytes int64  // cap for the "/cache/" storage-diskcache handler; 0 for defaultCacheMaxBytes
+
+	publish jsonconfig.Obj
+}
+
+// genOwnerPrefixes generates the full prefix subtree (blob storage,
+// index, UI, sighelper, publish roots, etc.) for one owner, namespaced
+// under o.base. It's used both for the default root owner and for each
+// "tenants" entry, so that every tenant gets the same isolated tree
+// (e.g. "/t/alice/bs/", "/t/alice/ui/", "/t/alice/sighelper/") that the
+// root owner gets at "/".
+func genOwnerPrefixes(o *ownerSpec) (jsonconfig.Obj, string, error) {
+	nolocaldisk := o.blobPath == ""
+	if nolocaldisk && o.s3 == "" && o.googlecloudstorage == "" && o.swift == "" {
+		return nil, "", errors.New("You need at least one of blobPath (for localdisk), s3, googlecloudstorage, or swift configured for a blobserver.")
+	}
+
+	var indexerPath string
+	numIndexers := numSet(o.mongo, o.mysql, o.postgres, o.sqliteFile, o.memIndex)
+	switch {
+	case o.runIndex && numIndexers == 0:
+		return nil, "", fmt.Errorf("Unless wantIndex is set to false, you must specify an index option (mongo, mysql, postgres, sqlite, memIndex).")
+	case o.runIndex && numIndexers != 1:
+		return nil, "", fmt.Errorf("With wantIndex set true, you can only pick exactly one indexer (mongo, mysql, postgres, sqlite, memIndex).")
+	case !o.runIndex && numIndexers != 0:
+		return nil, "", fmt.Errorf("With wantIndex disabled, you can't specify any of mongo, mysql, postgres, sqlite, memIndex.")
+	case o.mysql != "":
+		indexerPath = o.base + "/index-mysql/"
+	case o.postgres != "":
+		indexerPath = o.base + "/index-postgres/"
+	case o.mongo != "":
+		indexerPath = o.base + "/index-mongo/"
+	case o.sqliteFile != "":
+		indexerPath = o.base + "/index-sqlite/"
+	case o.memIndex:
+		indexerPath = o.base + "/index-mem/"
+	}
+
+	entity, err := jsonsign.EntityFromSecring(o.keyId, o.secretRing)
+	if err != nil {
+		return nil, "", err
+	}
+	armoredPublicKey, err := jsonsign.ArmoredPublicKey(entity)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cacheMaxBytes := o.cacheMaxBytes
+	if cacheMaxBytes == 0 {
+		cacheMaxBytes = defaultCacheMaxBytes
+	}
+	cacheDir := o.cachePath
+	if cacheDir == "" {
+		if nolocaldisk {
+			// Whether camlistored is run from EC2 or not, we use
+			// a temp dir as the cache when primary storage is S3.
+			// Each owner (the root owner, or a tenant) gets its
+			// own subdirectory, namespaced the same way as its
+			// prefixes, so that distinct S3-backed owners don't
+			// share a cache and corrupt each other's blobs.
+			// TODO(mpl): s3CacheBucket
+			// See http://code.google.com/p/camlistore/issues/detail?id=85
+			ownerDir := "root"
+			if o.base != "" {
+				ownerDir = strings.TrimPrefix(o.base, "/")
+			}
+			cacheDir = filepath.Join(tempDir(), "camli-cache", ownerDir)
+		} else {
+			cacheDir = filepath.Join(o.blobPath, "/cache")
+		}
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, "", fmt.Errorf("Could not create blobs cache dir %s: %v", cacheDir, err)
+	}
+
+	prefixes, blobRoot := genLowLevelPrefixes(&configPrefixesParams{
+		base:            o.base,
+		auth:            o.auth,
+		secretRing:      o.secretRing,
+		keyId:           o.keyId,
+		indexerPath:     indexerPath,
+		blobPath:        o.blobPath,
+		searchOwner:     blobref.SHA1FromString(armoredPublicKey),
+		shareHandler:    o.shareHandler,
+		encryptKeyFile:  o.encryptKeyFile,
+		encryptMetaArgs: o.encryptMetaArgs,
+		cachePath:       cacheDir,
+		cacheMaxBytes:   cacheMaxBytes,
+	})
+
+	published := []interface{}{}
+	if len(o.publish) > 0 {
+		if !o.runIndex {
+			return nil, "", fmt.Errorf("publishing requires an index")
+		}
+		published, err = addPublishedConfig(prefixes, o.base, o.publish)
+		if err != nil {
+			return nil, "", fmt.Errorf("Could not generate config for published: %v", err)
+		}
+	}
+
+	if o.runIndex {
+		addUIConfig(prefixes, o.base, published)
+	}
+
+	if o.mysql != "" {
+		addMySQLConfig(prefixes, o.base, o.dbname, o.mysql)
+	}
+	if o.postgres != "" {
+		addPostgresConfig(prefixes, o.base, o.dbname, o.postgres)
+	}
+	if o.mongo != "" {
+		addMongoConfig(prefixes, o.base, o.dbname, o.mongo)
+	}
+	if o.sqliteFile != "" {
+		addSQLiteConfig(prefixes, o.base, o.sqliteFile)
+	}
+	if o.s3 != "" {
+		if err := addS3Config(prefixes, o.base, o.s3, cacheDir, cacheMaxBytes); err != nil {
+			return nil, "", err
+		}
+	}
+	if o.googlecloudstorage != "" {
+		if err := addGCSConfig(prefixes, o.base, o.googlecloudstorage, cacheDir, cacheMaxBytes); err != nil {
+			return nil, "", err
+		}
+	}
+	if o.swift != "" {
+		if err := addSwiftConfig(prefixes, o.base, o.swift, cacheDir, cacheMaxBytes); err != nil {
+			return nil, "", err
+		}
+	}
+	if indexerPath == o.base+"/index-mem/" {
+		addMemindexConfig(prefixes, o.base)
+	}
+
+	return prefixes, blobRoot, nil
+}
+
+// validTenantName matches the tenant keys accepted in the "tenants"
+// config object. Tenant names become the "/t/<name>" path segment
+// mounting their prefix subtree, so anything that could escape that
+// segment (e.g. "/" or "..") is rejected.
+var validTenantName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// addTenantsConfig generates an isolated prefix subtree per entry of the
+// high-level "tenants" object and merges them all into prefixes, so
+// that tenants share the listener and auth/storage machinery of this
+// file while keeping their own identity, blob storage, and index.
+func addTenantsConfig(prefixes jsonconfig.Obj, tenants jsonconfig.Obj, dbname string) error {
+	for name, v := range tenants {
+		if !validTenantName.MatchString(name) {
+			return fmt.Errorf("genconfig: invalid tenant name %q: must match %s", name, validTenantName.String())
+		}
+		t, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("genconfig: tenant %q config must be an object", name)
+		}
+		tAuth, _ := t["auth"].(string)
+		tKeyId, _ := t["identity"].(string)
+		tSecretRing, _ := t["secretRing"].(string)
+		if tAuth == "" || tKeyId == "" || tSecretRing == "" {
+			return fmt.Errorf(`genconfig: tenant %q needs "auth", "identity", and "secretRing"`, name)
+		}
+		tBlobPath, _ := t["blobPath"].(string)
+		tS3, _ := t["s3"].(string)
+		tPublish, _ := t["publish"].(map[string]interface{})
+		tMysql, _ := t["mysql"].(string)
+		tPostgres, _ := t["postgres"].(string)
+		tMongo, _ := t["mongo"].(string)
+		tSqliteFile, _ := t["sqlite"].(string)
+		tMemIndex, _ := t["memIndex"].(bool)
+		tDbname, _ := t["dbname"].(string)
+		if tDbname == "" {
+			tDbname = dbname + "_" + name
+		}
+
+		tenantPrefixes, _, err := genOwnerPrefixes(&ownerSpec{
+			base:         "/t/" + name,
+			auth:         tAuth,
+			keyId:        tKeyId,
+			secretRing:   tSecretRing,
+			shareHandler: true,
+			blobPath:     tBlobPath,
+			s3:           tS3,
+			runIndex:     tMysql != "" || tPostgres != "" || tMongo != "" || tSqliteFile != "" || tMemIndex,
+			dbname:       tDbname,
+			mysql:        tMysql,
+			postgres:     tPostgres,
+			mongo:        tMongo,
+			sqliteFile:   tSqliteFile,
+			memIndex:     tMemIndex,
+			publish:      tPublish,
+		})
+		if err != nil {
+			return fmt.Errorf("genconfig: tenant %q: %v", name, err)
+		}
+		for k, v := range tenantPrefixes {
+			prefixes[k] = v
+		}
+	}
+	return nil
+}
+
 // genLowLevelConfig returns a low-level config from a high-level config.
 func genLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 	var (
@@ -350,9 +912,11 @@ func genLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 		tlsKey     = conf.OptionalString("HTTPSKeyFile", "")
 
 		// Blob storage options
-		blobPath     = conf.OptionalString("blobPath", "")
-		s3           = conf.OptionalString("s3", "")           // "access_key_id:secret_access_key:bucket"
-		shareHandler = conf.OptionalBool("shareHandler", true) // enable the share handler
+		blobPath           = conf.OptionalString("blobPath", "")
+		s3                 = conf.OptionalString("s3", "")                 // "access_key_id:secret_access_key:bucket"
+		googlecloudstorage = conf.OptionalString("googlecloudstorage", "") // "client_id:client_secret:refresh_token:bucket"
+		swift              = conf.OptionalString("swift", "")              // "user:key:tenant:authurl:container"
+		shareHandler       = conf.OptionalBool("shareHandler", true)       // enable the share handler
 
 		// Index options
 		runIndex   = conf.OptionalBool("runIndex", true) // if false: no search, no UI, etc.
@@ -363,8 +927,11 @@ func genLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 		mongo      = conf.OptionalString("mongo", "")
 		sqliteFile = conf.OptionalString("sqlite", "")
 
-		_       = conf.OptionalList("replicateTo")
-		publish = conf.OptionalObject("publish")
+		replication = conf.OptionalObject("replication")
+		encrypt     = conf.OptionalObject("encrypt")
+		publish     = conf.OptionalObject("publish")
+		tenants     = conf.OptionalObject("tenants")
+		cache       = conf.OptionalObject("cache")
 	)
 	if err := conf.Validate(); err != nil {
 		return nil, err
@@ -404,100 +971,69 @@ func genLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 		dbname = "camli" + username
 	}
 
-	var indexerPath string
-	numIndexers := numSet(mongo, mysql, postgres, sqliteFile, memIndex)
-	switch {
-	case runIndex && numIndexers == 0:
-		return nil, fmt.Errorf("Unless wantIndex is set to false, you must specify an index option (mongo, mysql, postgres, sqlite, memIndex).")
-	case runIndex && numIndexers != 1:
-		return nil, fmt.Errorf("With wantIndex set true, you can only pick exactly one indexer (mongo, mysql, postgres, sqlite, memIndex).")
-	case !runIndex && numIndexers != 0:
-		return nil, fmt.Errorf("With wantIndex disabled, you can't specify any of mongo, mysql, postgres, sqlite, memIndex.")
-	case mysql != "":
-		indexerPath = "/index-mysql/"
-	case postgres != "":
-		indexerPath = "/index-postgres/"
-	case mongo != "":
-		indexerPath = "/index-mongo/"
-	case sqliteFile != "":
-		indexerPath = "/index-sqlite/"
-	case memIndex:
-		indexerPath = "/index-mem/"
+	var encryptKeyFile string
+	var encryptMetaArgs map[string]interface{}
+	if len(encrypt) > 0 {
+		encryptKeyFile, _ = encrypt["keyFile"].(string)
+		if encryptKeyFile == "" {
+			return nil, errors.New(`genconfig: "encrypt" requires a "keyFile"`)
+		}
+		if metaIndex, ok := encrypt["metaIndex"].(map[string]interface{}); ok {
+			encryptMetaArgs, err = encryptMetaIndexArgs(metaIndex, dbname)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	entity, err := jsonsign.EntityFromSecring(keyId, secretRing)
-	if err != nil {
-		return nil, err
+	var cachePath string
+	var cacheMaxBytes int64
+	if len(cache) > 0 {
+		cachePath, _ = cache["path"].(string)
+		if v, ok := cache["maxBytes"]; ok {
+			cacheMaxBytes, err = parseByteSize(v)
+			if err != nil {
+				return nil, fmt.Errorf(`genconfig: "cache.maxBytes": %v`, err)
+			}
+		}
 	}
-	armoredPublicKey, err := jsonsign.ArmoredPublicKey(entity)
+
+	prefixes, blobRoot, err := genOwnerPrefixes(&ownerSpec{
+		keyId:              keyId,
+		secretRing:         secretRing,
+		shareHandler:       shareHandler,
+		blobPath:           blobPath,
+		s3:                 s3,
+		googlecloudstorage: googlecloudstorage,
+		swift:              swift,
+		runIndex:           runIndex,
+		dbname:             dbname,
+		mysql:              mysql,
+		postgres:           postgres,
+		mongo:              mongo,
+		sqliteFile:         sqliteFile,
+		memIndex:           memIndex,
+		encryptKeyFile:     encryptKeyFile,
+		encryptMetaArgs:    encryptMetaArgs,
+		cachePath:          cachePath,
+		cacheMaxBytes:      cacheMaxBytes,
+		publish:            publish,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	nolocaldisk := blobPath == ""
-	if nolocaldisk && s3 == "" {
-		return nil, errors.New("You need at least one of blobPath (for localdisk) or s3 configured for a blobserver.")
-	}
-
-	prefixesParams := &configPrefixesParams{
-		secretRing:   secretRing,
-		keyId:        keyId,
-		indexerPath:  indexerPath,
-		blobPath:     blobPath,
-		searchOwner:  blobref.SHA1FromString(armoredPublicKey),
-		shareHandler: shareHandler,
-	}
-
-	prefixes := genLowLevelPrefixes(prefixesParams)
-	var cacheDir string
-	if nolocaldisk {
-		// Whether camlistored is run from EC2 or not, we use
-		// a temp dir as the cache when primary storage is S3.
-		// TODO(mpl): s3CacheBucket
-		// See http://code.google.com/p/camlistore/issues/detail?id=85
-		cacheDir = filepath.Join(tempDir(), "camli-cache")
-	} else {
-		cacheDir = filepath.Join(blobPath, "/cache")
-	}
-	if err := os.MkdirAll(cacheDir, 0700); err != nil {
-		return nil, fmt.Errorf("Could not create blobs cache dir %s: %v", cacheDir, err)
-	}
-
-	published := []interface{}{}
-	if len(publish) > 0 {
-		if !runIndex {
-			return nil, fmt.Errorf("publishing requires an index")
-		}
-		published, err = addPublishedConfig(prefixes, publish)
-		if err != nil {
-			return nil, fmt.Errorf("Could not generate config for published: %v", err)
+	if len(replication) > 0 {
+		if err := addReplicationConfig(prefixes, blobRoot, encryptKeyFile, replication); err != nil {
+			return nil, err
 		}
 	}
 
-	if runIndex {
-		addUIConfig(prefixes, "/ui/", published)
-	}
-
-	if mysql != "" {
-		addMySQLConfig(prefixes, dbname, mysql)
-	}
-	if postgres != "" {
-		addPostgresConfig(prefixes, dbname, postgres)
-	}
-	if mongo != "" {
-		addMongoConfig(prefixes, dbname, mongo)
-	}
-	if sqliteFile != "" {
-		addSQLiteConfig(prefixes, sqliteFile)
-	}
-	if s3 != "" {
-		if err := addS3Config(prefixes, s3); err != nil {
+	if len(tenants) > 0 {
+		if err := addTenantsConfig(prefixes, tenants, dbname); err != nil {
 			return nil, err
 		}
 	}
-	if indexerPath == "/index-mem/" {
-		addMemindexConfig(prefixes)
-	}
 
 	obj["prefixes"] = (map[string]interface{})(prefixes)
 
@@ -508,6 +1044,34 @@ func genLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 	return lowLevelConf, nil
 }
 
+// parseByteSize parses a "cache.maxBytes" value: either a JSON number
+// (interpreted as a byte count) or a string with an optional "KB",
+// "MB", or "GB" suffix (e.g. "2GB").
+func parseByteSize(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case float64:
+		return int64(v), nil
+	case string:
+		mult := int64(1)
+		s := v
+		switch {
+		case strings.HasSuffix(s, "GB"):
+			mult, s = 1<<30, strings.TrimSuffix(s, "GB")
+		case strings.HasSuffix(s, "MB"):
+			mult, s = 1<<20, strings.TrimSuffix(s, "MB")
+		case strings.HasSuffix(s, "KB"):
+			mult, s = 1<<10, strings.TrimSuffix(s, "KB")
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid size %q", v)
+		}
+		return n * mult, nil
+	default:
+		return 0, fmt.Errorf("invalid size %v", v)
+	}
+}
+
 func numSet(vv ...interface{}) (num int) {
 	for _, vi := range vv {
 		switch v := vi.(type) {
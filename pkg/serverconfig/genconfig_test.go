@@ -0,0 +1,179 @@
+/*
+Copyright 2012 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package serverconfig
+
+import (
+	"testing"
+
+	"camlistore.org/pkg/jsonconfig"
+)
+
+func backendsOf(t *testing.T, prefixes jsonconfig.Obj, prefix string) []interface{} {
+	t.Helper()
+	h, ok := prefixes[prefix].(map[string]interface{})
+	if !ok {
+		t.Fatalf("prefixes[%q] missing or not an object", prefix)
+	}
+	args, ok := h["handlerArgs"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("prefixes[%q].handlerArgs missing or not an object", prefix)
+	}
+	backends, ok := args["backends"].([]interface{})
+	if !ok {
+		t.Fatalf("prefixes[%q].handlerArgs.backends missing or not a list", prefix)
+	}
+	return backends
+}
+
+func blobRootOf(t *testing.T, prefixes jsonconfig.Obj, prefix string) string {
+	t.Helper()
+	h, ok := prefixes[prefix].(map[string]interface{})
+	if !ok {
+		t.Fatalf("prefixes[%q] missing or not an object", prefix)
+	}
+	args, ok := h["handlerArgs"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("prefixes[%q].handlerArgs missing or not an object", prefix)
+	}
+	blobRoot, _ := args["blobRoot"].(string)
+	return blobRoot
+}
+
+func replicationSpec(minWrites int) jsonconfig.Obj {
+	return jsonconfig.Obj{
+		"backends": []interface{}{
+			map[string]interface{}{"blobPath": "/var/replica1"},
+			map[string]interface{}{"blobPath": "/var/replica2"},
+		},
+		// minWritesForSuccess arrives as a float64 once a real JSON
+		// config is unmarshaled, so mimic that here.
+		"minWritesForSuccess": float64(minWrites),
+	}
+}
+
+// TestAddReplicationConfig_Plain covers a plain (unencrypted) primary
+// with no indexer: the root handler's blobRoot should be rewired from
+// "/bs/" to "/bs-replicated/", and the replica set's first backend
+// should be the original "/bs/".
+func TestAddReplicationConfig_Plain(t *testing.T) {
+	prefixes := jsonconfig.Obj{
+		"/": map[string]interface{}{
+			"handler":     "root",
+			"handlerArgs": map[string]interface{}{"blobRoot": "/bs/"},
+		},
+	}
+	if err := addReplicationConfig(prefixes, "/bs/", "", replicationSpec(2)); err != nil {
+		t.Fatalf("addReplicationConfig: %v", err)
+	}
+	if got := blobRootOf(t, prefixes, "/"); got != "/bs-replicated/" {
+		t.Errorf("root blobRoot = %q, want /bs-replicated/", got)
+	}
+	backends := backendsOf(t, prefixes, "/bs-replicated/")
+	if len(backends) != 3 {
+		t.Fatalf("got %d backends, want 3", len(backends))
+	}
+	if backends[0] != "/bs/" {
+		t.Errorf("backends[0] = %v, want /bs/", backends[0])
+	}
+}
+
+// TestAddReplicationConfig_Encrypted covers replication on top of an
+// encrypted primary: every replica backend must receive the same
+// already-encrypted bytes, so "/encrypt-bs/" is rewired to wrap the
+// whole "/bs-replicated-raw/" replica set instead of the bare "/bs/",
+// and the replica set itself must still replicate the raw "/bs/"
+// store (not a second, independent encrypt wrapper per backend).
+func TestAddReplicationConfig_Encrypted(t *testing.T) {
+	prefixes := jsonconfig.Obj{
+		"/": map[string]interface{}{
+			"handler":     "root",
+			"handlerArgs": map[string]interface{}{"blobRoot": "/encrypt-bs/"},
+		},
+		"/encrypt-bs/": map[string]interface{}{
+			"handler": "storage-encrypt",
+			"handlerArgs": map[string]interface{}{
+				"keyFile":  "/secrets/encrypt.key",
+				"blobRoot": "/bs/",
+			},
+		},
+	}
+	if err := addReplicationConfig(prefixes, "/encrypt-bs/", "/secrets/encrypt.key", replicationSpec(2)); err != nil {
+		t.Fatalf("addReplicationConfig: %v", err)
+	}
+	// The root handler still points at /encrypt-bs/: nothing else needs
+	// to change, since the encrypt wrapper now fronts the whole
+	// replica set.
+	if got := blobRootOf(t, prefixes, "/"); got != "/encrypt-bs/" {
+		t.Errorf("root blobRoot = %q, want unchanged /encrypt-bs/", got)
+	}
+	if got := blobRootOf(t, prefixes, "/encrypt-bs/"); got != "/bs-replicated-raw/" {
+		t.Errorf("encrypt-bs blobRoot = %q, want /bs-replicated-raw/", got)
+	}
+	if _, ok := prefixes["/bs-replicated/"]; ok {
+		t.Error("plaintext /bs-replicated/ should not be created when encryption is enabled")
+	}
+	backends := backendsOf(t, prefixes, "/bs-replicated-raw/")
+	if len(backends) != 3 {
+		t.Fatalf("got %d backends, want 3", len(backends))
+	}
+	if backends[0] != "/bs/" {
+		t.Errorf("backends[0] = %v, want raw /bs/ (not a per-backend encrypt wrapper)", backends[0])
+	}
+}
+
+func TestAddReplicationConfig_MinWritesOutOfRange(t *testing.T) {
+	for _, minWrites := range []int{0, 4} {
+		prefixes := jsonconfig.Obj{
+			"/": map[string]interface{}{
+				"handler":     "root",
+				"handlerArgs": map[string]interface{}{"blobRoot": "/bs/"},
+			},
+		}
+		if err := addReplicationConfig(prefixes, "/bs/", "", replicationSpec(minWrites)); err == nil {
+			t.Errorf("minWritesForSuccess=%d: want error, got nil", minWrites)
+		}
+	}
+}
+
+func TestValidTenantName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"alice", true},
+		{"alice-bob_2", true},
+		{"../escape", false},
+		{"a/b", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validTenantName.MatchString(tt.name); got != tt.want {
+			t.Errorf("validTenantName.MatchString(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCacheHandlerArgs(t *testing.T) {
+	got := cacheHandlerArgs("/var/camli-cache", defaultCacheMaxBytes)
+	want := map[string]interface{}{
+		"path":     "/var/camli-cache",
+		"maxBytes": int64(defaultCacheMaxBytes),
+	}
+	if got["path"] != want["path"] || got["maxBytes"] != want["maxBytes"] {
+		t.Errorf("cacheHandlerArgs(...) = %+v, want %+v", got, want)
+	}
+}